@@ -0,0 +1,400 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/chris-wood/ohttp-go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	configEndpoint  = "/ohttp-keys"
+	gatewayEndpoint = "/gateway"
+	echoEndpoint    = "/gateway-echo"
+
+	ohttpRequestContentType  = "message/ohttp-req"
+	ohttpResponseContentType = "message/ohttp-res"
+
+	twelveHours     = 12 * 60 * 60
+	twentyFourHours = 24 * 60 * 60
+)
+
+var (
+	// TargetForbiddenError is returned by an AppRequestHandler when the
+	// decapsulated request targets a host the gateway is not configured
+	// to forward to.
+	TargetForbiddenError = errors.New("target request forbidden")
+
+	// ErrUnknownKeyID is returned when an encapsulated request names a
+	// key ID the gateway does not serve.
+	ErrUnknownKeyID = errors.New("unknown key ID")
+)
+
+// gatewayResource holds the state backing the gateway's HTTP handlers: the
+// set of OHTTP configs used to decapsulate/encapsulate requests and
+// responses, the handlers registered per endpoint, and the metrics factory
+// used to report request outcomes.
+type gatewayResource struct {
+	keys                  *keyRegistry
+	encapsulationHandlers map[string]EncapsulationHandler
+	debugResponse         bool
+	metricsFactory        MetricsFactory
+
+	// MaxRequestsInFlight bounds how many encapsulated requests
+	// gatewayHandler will decapsulate and handle concurrently, the same
+	// way Kubernetes' generic apiserver bounds in-flight requests: once
+	// the bound is reached, new requests are rejected with 503 rather
+	// than queued. 0 means unbounded. Construct gatewayResource with
+	// newGatewayResource rather than setting this directly, so that
+	// requestSlots is always derived from it.
+	MaxRequestsInFlight int
+
+	// requestSlots is the MaxRequestsInFlight semaphore, derived from it
+	// by newGatewayResource. It is not meant to be set independently of
+	// MaxRequestsInFlight.
+	requestSlots chan struct{}
+}
+
+// newGatewayResource builds a gatewayResource backing the gateway's HTTP
+// handlers, deriving its MaxRequestsInFlight semaphore from
+// maxRequestsInFlight so that callers have a single number to set rather
+// than a channel that must be kept in sync with it by hand.
+func newGatewayResource(keys *keyRegistry, encapsulationHandlers map[string]EncapsulationHandler, debugResponse bool, metricsFactory MetricsFactory, maxRequestsInFlight int) gatewayResource {
+	return gatewayResource{
+		keys:                  keys,
+		encapsulationHandlers: encapsulationHandlers,
+		debugResponse:         debugResponse,
+		metricsFactory:        metricsFactory,
+		MaxRequestsInFlight:   maxRequestsInFlight,
+		requestSlots:          newSlots(maxRequestsInFlight),
+	}
+}
+
+// configHandler serves the gateway's OHTTP key configuration so that
+// clients can learn how to encapsulate requests for this gateway. All
+// currently active keys are advertised, concatenated per the OHTTP key
+// configuration format, so clients mid-rotation can pick up a new key
+// without a gap in service.
+func (g gatewayResource) configHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := g.metricsFactory.Create(metricsEventConfigRequest)
+
+	configs, err := g.keys.MarshalledConfigs()
+	if err != nil {
+		metrics.Fire(metricsResultConfigurationMismatch)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := twelveHours + twentyFourHours/2
+	if g.keys.HasPendingRetirement() {
+		// Shorten the advertised lifetime while a key is scheduled for
+		// removal so clients refresh and stop relying on it sooner.
+		maxAge = twelveHours / 2
+	}
+
+	w.Header().Set("Content-Type", "application/ohttp-keys")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, private", maxAge))
+	for _, config := range configs {
+		w.Write(config)
+	}
+	metrics.Fire(metricsResultSuccess)
+}
+
+// gatewayHandler accepts an encapsulated OHTTP request, dispatches it to
+// the EncapsulationHandler registered for the requested endpoint, and
+// writes back the resulting encapsulated OHTTP response.
+func (g gatewayResource) gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := g.metricsFactory.Create(metricsEventGatewayRequest)
+
+	if r.Method != http.MethodPost {
+		metrics.Fire(metricsResultInvalidMethod)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != ohttpRequestContentType {
+		metrics.Fire(metricsResultInvalidContentType)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid content type: %s", contentType)
+		return
+	}
+
+	handler, ok := g.encapsulationHandlers[r.URL.Path]
+	if !ok {
+		metrics.Fire(metricsResultNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	if g.requestSlots != nil {
+		select {
+		case g.requestSlots <- struct{}{}:
+			release := newMainSlotReleaser(g.requestSlots)
+			defer release()
+			ctx = withMainSlotRelease(ctx, release)
+		default:
+			metrics.Fire(metricsResultThrottled)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		metrics.Fire(metricsResultDecapsulationFailed)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	encapResponse, err := handler.Handle(ctx, body, metrics)
+	if err != nil {
+		if errors.Is(err, ErrUnknownKeyID) {
+			metrics.Fire(metricsResultConfigurationMismatch)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		metrics.Fire(metricsResultDecapsulationFailed)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", ohttpResponseContentType)
+	w.Write(encapResponse)
+}
+
+// newSlots returns a buffered channel sized for use as a concurrency
+// semaphore, or nil if max is not positive, meaning unbounded.
+func newSlots(max int) chan struct{} {
+	if max <= 0 {
+		return nil
+	}
+	return make(chan struct{}, max)
+}
+
+// newMainSlotReleaser returns a function that gives back the slot
+// gatewayHandler just reserved from slots. It is safe to call more than
+// once: only the first call releases the slot, so a handler that releases
+// it early (see withMainSlotRelease) does not cause gatewayHandler's own
+// deferred release to double-release it.
+func newMainSlotReleaser(slots chan struct{}) func() {
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }
+}
+
+// mainSlotReleaseKey is the context key under which gatewayHandler stashes
+// the release func for the MaxRequestsInFlight slot it reserved, so that a
+// handler further down the chain can give it back early.
+type mainSlotReleaseKey struct{}
+
+// withMainSlotRelease attaches release to ctx so a handler deep in the
+// dispatch chain can release gatewayHandler's MaxRequestsInFlight slot as
+// soon as it determines the request should be governed by a different
+// bound instead, e.g. ProtoHTTPEncapsulationHandler's long-running slots.
+func withMainSlotRelease(ctx context.Context, release func()) context.Context {
+	return context.WithValue(ctx, mainSlotReleaseKey{}, release)
+}
+
+// releaseMainSlot releases the MaxRequestsInFlight slot attached to ctx by
+// withMainSlotRelease, if any. It is a no-op if ctx carries none.
+func releaseMainSlot(ctx context.Context) {
+	if release, ok := ctx.Value(mainSlotReleaseKey{}).(func()); ok {
+		release()
+	}
+}
+
+// EncapsulationHandler decapsulates an OHTTP request, dispatches the
+// contained request to an AppRequestHandler, and re-encapsulates the
+// resulting response.
+type EncapsulationHandler interface {
+	Handle(ctx context.Context, encapsulatedRequest []byte, metrics Metrics) ([]byte, error)
+}
+
+// AppRequestHandler handles a single decapsulated application request.
+type AppRequestHandler interface {
+	Handle(req *http.Request, metrics Metrics) (*http.Response, error)
+}
+
+// DefaultEncapsulationHandler is the standard EncapsulationHandler: it
+// decapsulates using whichever active OHTTP config matches the request's
+// key ID, hands the decapsulated content to an AppRequestHandler, and
+// encapsulates whatever that handler returns.
+type DefaultEncapsulationHandler struct {
+	keys           *keyRegistry
+	appHandler     AppRequestHandler
+	metricsFactory MetricsFactory
+}
+
+func (h DefaultEncapsulationHandler) Handle(ctx context.Context, encapsulatedRequest []byte, metrics Metrics) ([]byte, error) {
+	req, err := ohttp.UnmarshalEncapsulatedRequest(encapsulatedRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, ok := h.keys.Gateway(req.KeyID)
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	if h.keys.IsRetiring(req.KeyID) && h.metricsFactory != nil {
+		h.metricsFactory.Create(metricsEventKeyRotation).Fire(metricsResultRetiredKey)
+	}
+
+	binaryRequest, responseContext, err := gateway.DecapsulateRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	appReq := (&http.Request{Body: io.NopCloser(bytes.NewReader(binaryRequest))}).WithContext(ctx)
+	resp, err := h.appHandler.Handle(appReq, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	encapResponse, err := responseContext.EncapsulateResponse(respBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return encapResponse.Marshal(), nil
+}
+
+// EchoAppHandler is a debug AppRequestHandler that echoes the decapsulated
+// content back unmodified. It is only wired up when debugResponse is set.
+type EchoAppHandler struct{}
+
+func (h EchoAppHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// ProtoHTTPEncapsulationHandler treats the decapsulated content as a
+// protobuf-encoded Request, dispatches it to an inner AppRequestHandler as
+// a real http.Request, and encodes the resulting http.Response back into a
+// protobuf-encoded Response.
+type ProtoHTTPEncapsulationHandler struct {
+	httpHandler    AppRequestHandler
+	targetRewrites map[string]TargetRewrite
+	metricsFactory MetricsFactory
+
+	// longRunningRequestTargets matches the decapsulated request's target
+	// host and path against a separate, larger concurrency bound: a
+	// request it matches releases its MaxRequestsInFlight slot (see
+	// releaseMainSlot) and is governed by longRunningSlots instead, so a
+	// few slow upstreams cannot starve short requests out of
+	// MaxRequestsInFlight's shared pool.
+	longRunningRequestTargets *regexp.Regexp
+	longRunningSlots          chan struct{}
+}
+
+func (h ProtoHTTPEncapsulationHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	protoReq := &Request{}
+	if err := proto.Unmarshal(body, protoReq); err != nil {
+		return nil, err
+	}
+
+	httpReq, err := protoHTTPToRequest(protoReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if rewrite, ok := h.targetRewrites[httpReq.Host]; ok {
+		applyTargetRewrite(httpReq, rewrite)
+		if h.metricsFactory != nil {
+			h.metricsFactory.Create(metricsEventTargetRewrite).Fire(metricsResultTargetRewritten)
+		}
+	}
+
+	throttled := false
+	if h.isLongRunning(httpReq) {
+		// This request is governed by longRunningSlots instead of the
+		// gateway-wide MaxRequestsInFlight bound from here on, so give
+		// back the slot gatewayHandler reserved for it before settling in
+		// for what may be a long wait.
+		releaseMainSlot(req.Context())
+
+		if h.longRunningSlots != nil {
+			select {
+			case h.longRunningSlots <- struct{}{}:
+				defer func() { <-h.longRunningSlots }()
+			default:
+				throttled = true
+			}
+		}
+	}
+
+	var resp *http.Response
+	if throttled {
+		metrics.Fire(metricsResultThrottled)
+		resp = &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Retry-After": []string{"1"}},
+		}
+	} else {
+		resp, err = h.httpHandler.Handle(httpReq, metrics)
+		if err != nil {
+			if errors.Is(err, TargetForbiddenError) {
+				resp = &http.Response{StatusCode: http.StatusForbidden}
+			} else {
+				return nil, err
+			}
+		}
+	}
+
+	protoResp, err := responseToProtoHTTP(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := proto.Marshal(protoResp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: int(protoResp.StatusCode),
+		Body:       io.NopCloser(bytes.NewReader(respBody)),
+	}, nil
+}
+
+// isLongRunning reports whether req's target matches
+// longRunningRequestTargets, and should therefore draw from the
+// long-running semaphore instead of the gateway-wide MaxRequestsInFlight
+// bound.
+func (h ProtoHTTPEncapsulationHandler) isLongRunning(req *http.Request) bool {
+	if h.longRunningRequestTargets == nil {
+		return false
+	}
+	return h.longRunningRequestTargets.MatchString(req.Host + req.URL.Path)
+}
@@ -5,34 +5,71 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/chris-wood/ohttp-go"
-	"github.com/cisco/go-hpke"
+	"github.com/cloudflare/circl/hpke"
 	"google.golang.org/protobuf/proto"
 )
 
 var (
 	FIXED_KEY_ID     = uint8(0x00)
+	ALTERNATE_KEY_ID = uint8(0x01)
 	FORBIDDEN_TARGET = "forbidden.example"
 	ALLOWED_TARGET   = "allowed.example"
 	GATEWAY_DEBUG    = true
 )
 
-func createGateway(t *testing.T) ohttp.Gateway {
-	config, err := ohttp.NewConfig(FIXED_KEY_ID, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+func createGateway(t *testing.T, keyID uint8) ohttp.Gateway {
+	config, err := ohttp.NewConfig(keyID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
 	if err != nil {
 		t.Fatal("Failed to create a valid config. Exiting now.")
 	}
 
-	return ohttp.NewDefaultGateway(config)
+	return ohttp.NewDefaultGateway([]ohttp.PrivateConfig{config})
+}
+
+// createKeyRegistry builds a keyRegistry with an active config for each of
+// keyIDs, using a fresh gateway per key so that tests can exercise
+// multi-key configuration and rotation.
+func createKeyRegistry(t *testing.T, keyIDs ...uint8) *keyRegistry {
+	keys := newKeyRegistry(func(keyID uint8) (ohttp.Gateway, error) {
+		return createGateway(t, keyID), nil
+	})
+	for _, keyID := range keyIDs {
+		if err := keys.AddConfig(keyID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+// mustClient builds an ohttp client against the config the target
+// currently advertises for keyID.
+func mustClient(t *testing.T, target gatewayResource, keyID uint8) ohttp.Client {
+	gateway, ok := target.keys.Gateway(keyID)
+	if !ok {
+		t.Fatalf("No gateway registered for key %d", keyID)
+	}
+
+	config, err := gateway.Config(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ohttp.NewDefaultClient(config)
 }
 
 type MockMetrics struct {
@@ -53,6 +90,7 @@ func (s *MockMetrics) Fire(result string) {
 }
 
 type MockMetricsFactory struct {
+	mu      sync.Mutex
 	metrics []*MockMetrics
 }
 
@@ -61,10 +99,20 @@ func (f *MockMetricsFactory) Create(eventName string) Metrics {
 		eventName: eventName,
 		isCalled:  false,
 	}
+	f.mu.Lock()
 	f.metrics = append(f.metrics, metrics)
+	f.mu.Unlock()
 	return metrics
 }
 
+// results returns a snapshot of the metrics recorded so far, safe to call
+// while other goroutines may still be firing metrics concurrently.
+func (f *MockMetricsFactory) results() []*MockMetrics {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*MockMetrics(nil), f.metrics...)
+}
+
 type ForbiddenCheckHttpRequestHandler struct {
 	forbidden string
 }
@@ -89,37 +137,69 @@ func (h ForbiddenCheckHttpRequestHandler) Handle(req *http.Request, metrics Metr
 	}, nil
 }
 
+// AllowlistCheckHttpRequestHandler is a test AppRequestHandler that mirrors
+// HttpRequestHandler's default-deny behavior (forbidden unless the target
+// is explicitly allowed) without making a real network call, for tests
+// that need to exercise default-deny rather than a single named target.
+type AllowlistCheckHttpRequestHandler struct {
+	allowed map[string]bool
+}
+
+func (h AllowlistCheckHttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if !h.allowed[req.Host] {
+		metrics.Fire(metricsResultTargetRequestForbidden)
+		return nil, TargetForbiddenError
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
 func createMockEchoGatewayServer(t *testing.T) gatewayResource {
-	gateway := createGateway(t)
+	return createMockEchoGatewayServerWithKeys(t, FIXED_KEY_ID)
+}
+
+// createMockEchoGatewayServerWithKeys is like createMockEchoGatewayServer
+// but advertises and accepts an arbitrary set of key IDs, for tests that
+// exercise multi-key configuration and rotation.
+func createMockEchoGatewayServerWithKeys(t *testing.T, keyIDs ...uint8) gatewayResource {
+	keys := createKeyRegistry(t, keyIDs...)
+	metricsFactory := &MockMetricsFactory{}
 	echoEncapHandler := DefaultEncapsulationHandler{
-		keyID:      FIXED_KEY_ID,
-		gateway:    gateway,
-		appHandler: EchoAppHandler{},
+		keys:           keys,
+		appHandler:     EchoAppHandler{},
+		metricsFactory: metricsFactory,
 	}
 	mockProtoHTTPFilterHandler := DefaultEncapsulationHandler{
-		keyID:   FIXED_KEY_ID,
-		gateway: gateway,
+		keys: keys,
 		appHandler: ProtoHTTPEncapsulationHandler{
 			httpHandler: ForbiddenCheckHttpRequestHandler{
 				FORBIDDEN_TARGET,
 			},
 		},
+		metricsFactory: metricsFactory,
 	}
 
 	encapHandlers := make(map[string]EncapsulationHandler)
 	encapHandlers[echoEndpoint] = echoEncapHandler
 	encapHandlers[gatewayEndpoint] = mockProtoHTTPFilterHandler
 	return gatewayResource{
-		gateway:               gateway,
+		keys:                  keys,
 		encapsulationHandlers: encapHandlers,
 		debugResponse:         GATEWAY_DEBUG,
-		metricsFactory:        &MockMetricsFactory{},
+		metricsFactory:        metricsFactory,
 	}
 }
 
 func TestConfigHandler(t *testing.T) {
 	target := createMockEchoGatewayServer(t)
-	config, err := target.gateway.Config(FIXED_KEY_ID)
+	gateway, ok := target.keys.Gateway(FIXED_KEY_ID)
+	if !ok {
+		t.Fatal("No gateway registered for fixed key")
+	}
+	config, err := gateway.Config(FIXED_KEY_ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,6 +244,8 @@ func TestConfigHandler(t *testing.T) {
 	} else {
 		t.Fatal("Cache-Control format should be 'max-age=86400, private'")
 	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventConfigRequest, metricsResultSuccess)
 }
 
 func testBodyContainsError(t *testing.T, resp *http.Response, expectedText string) {
@@ -178,7 +260,7 @@ func testBodyContainsError(t *testing.T, resp *http.Response, expectedText strin
 
 func testMetricsContainsResult(t *testing.T, metricsCollector *MockMetricsFactory, event string, result string) {
 
-	for _, metric := range metricsCollector.metrics {
+	for _, metric := range metricsCollector.results() {
 		if metric.eventName == event {
 			if !metric.isCalled {
 				t.Fatalf("Expected event %s was not fired", event)
@@ -221,11 +303,7 @@ func TestGatewayHandler(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	client := ohttp.NewDefaultClient(config)
+	client := mustClient(t, target, FIXED_KEY_ID)
 
 	testMessage := []byte{0xCA, 0xFE}
 	req, _, err := client.EncapsulateRequest(testMessage)
@@ -254,11 +332,7 @@ func TestGatewayHandlerWithInvalidMethod(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	client := ohttp.NewDefaultClient(config)
+	client := mustClient(t, target, FIXED_KEY_ID)
 
 	testMessage := []byte{0xCA, 0xFE}
 	req, _, err := client.EncapsulateRequest(testMessage)
@@ -285,7 +359,7 @@ func TestGatewayHandlerWithInvalidKey(t *testing.T) {
 	handler := http.HandlerFunc(target.gatewayHandler)
 
 	// Generate a new config that's different from the target's
-	privateConfig, err := ohttp.NewConfig(FIXED_KEY_ID, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+	privateConfig, err := ohttp.NewConfig(FIXED_KEY_ID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
 	if err != nil {
 		t.Fatal("Failed to create a valid config. Exiting now.")
 	}
@@ -316,7 +390,7 @@ func TestGatewayHandlerWithUnknownKey(t *testing.T) {
 	handler := http.HandlerFunc(target.gatewayHandler)
 
 	// Generate a new config that's different from the target's in the key ID
-	privateConfig, err := ohttp.NewConfig(FIXED_KEY_ID^0xFF, hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+	privateConfig, err := ohttp.NewConfig(FIXED_KEY_ID^0xFF, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
 	if err != nil {
 		t.Fatal("Failed to create a valid config. Exiting now.")
 	}
@@ -346,11 +420,7 @@ func TestGatewayHandlerWithCorruptContent(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	client := ohttp.NewDefaultClient(config)
+	client := mustClient(t, target, FIXED_KEY_ID)
 
 	// Corrupt the message
 	testMessage := []byte{0xCA, 0xFE}
@@ -379,11 +449,7 @@ func TestGatewayHandlerProtoHTTPRequestWithForbiddenTarget(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	client := ohttp.NewDefaultClient(config)
+	client := mustClient(t, target, FIXED_KEY_ID)
 
 	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", FORBIDDEN_TARGET, gatewayEndpoint), nil)
 	if err != nil {
@@ -447,11 +513,7 @@ func TestGatewayHandlerProtoHTTPRequestWithAllowedTarget(t *testing.T) {
 
 	handler := http.HandlerFunc(target.gatewayHandler)
 
-	config, err := target.gateway.Config(FIXED_KEY_ID)
-	if err != nil {
-		t.Fatal(err)
-	}
-	client := ohttp.NewDefaultClient(config)
+	client := mustClient(t, target, FIXED_KEY_ID)
 
 	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", ALLOWED_TARGET, gatewayEndpoint), nil)
 	if err != nil {
@@ -513,3 +575,538 @@ func TestGatewayHandlerProtoHTTPRequestWithAllowedTarget(t *testing.T) {
 
 	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
 }
+
+var (
+	REWRITE_SOURCE_ALLOWED   = "client-facing-allowed.example"
+	REWRITE_SOURCE_FORBIDDEN = "client-facing-forbidden.example"
+	REWRITE_SOURCE_UNMATCHED = "client-facing-unmatched.example"
+)
+
+func createMockRewriteGatewayServer(t *testing.T) gatewayResource {
+	keys := createKeyRegistry(t, FIXED_KEY_ID)
+	targetRewrites := map[string]TargetRewrite{
+		REWRITE_SOURCE_ALLOWED:   {Scheme: "http", Host: ALLOWED_TARGET},
+		REWRITE_SOURCE_FORBIDDEN: {Scheme: "http", Host: FORBIDDEN_TARGET},
+	}
+	metricsFactory := &MockMetricsFactory{}
+	mockProtoHTTPFilterHandler := DefaultEncapsulationHandler{
+		keys: keys,
+		appHandler: ProtoHTTPEncapsulationHandler{
+			httpHandler: ForbiddenCheckHttpRequestHandler{
+				FORBIDDEN_TARGET,
+			},
+			targetRewrites: targetRewrites,
+			metricsFactory: metricsFactory,
+		},
+		metricsFactory: metricsFactory,
+	}
+
+	encapHandlers := make(map[string]EncapsulationHandler)
+	encapHandlers[gatewayEndpoint] = mockProtoHTTPFilterHandler
+	return gatewayResource{
+		keys:                  keys,
+		encapsulationHandlers: encapHandlers,
+		debugResponse:         GATEWAY_DEBUG,
+		metricsFactory:        metricsFactory,
+	}
+}
+
+// createMockRewriteGatewayServerWithAllowlist is like
+// createMockRewriteGatewayServer, but backs the gateway with an
+// AllowlistCheckHttpRequestHandler instead of a
+// ForbiddenCheckHttpRequestHandler, so tests can exercise default-deny
+// behavior for a target that no rewrite applies to, rather than only
+// whether one specific host is forbidden.
+func createMockRewriteGatewayServerWithAllowlist(t *testing.T) gatewayResource {
+	keys := createKeyRegistry(t, FIXED_KEY_ID)
+	targetRewrites := map[string]TargetRewrite{
+		REWRITE_SOURCE_ALLOWED:   {Scheme: "http", Host: ALLOWED_TARGET},
+		REWRITE_SOURCE_FORBIDDEN: {Scheme: "http", Host: FORBIDDEN_TARGET},
+	}
+	metricsFactory := &MockMetricsFactory{}
+	mockProtoHTTPFilterHandler := DefaultEncapsulationHandler{
+		keys: keys,
+		appHandler: ProtoHTTPEncapsulationHandler{
+			httpHandler: AllowlistCheckHttpRequestHandler{
+				allowed: map[string]bool{ALLOWED_TARGET: true},
+			},
+			targetRewrites: targetRewrites,
+			metricsFactory: metricsFactory,
+		},
+		metricsFactory: metricsFactory,
+	}
+
+	encapHandlers := make(map[string]EncapsulationHandler)
+	encapHandlers[gatewayEndpoint] = mockProtoHTTPFilterHandler
+	return gatewayResource{
+		keys:                  keys,
+		encapsulationHandlers: encapHandlers,
+		debugResponse:         GATEWAY_DEBUG,
+		metricsFactory:        metricsFactory,
+	}
+}
+
+func sendAndDecapsulateProtoHTTPRequest(t *testing.T, target gatewayResource, targetHost string) (*http.Response, *Response) {
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	client := mustClient(t, target, FIXED_KEY_ID)
+
+	httpRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", targetHost, gatewayEndpoint), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryRequest, err := requestToProtoHTTP(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedRequest, err := proto.Marshal(binaryRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, context, err := client.EncapsulateRequest(encodedRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, gatewayEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	resp := rr.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encapResp, err := ohttp.UnmarshalEncapsulatedResponse(bodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryResp, err := context.DecapsulateResponse(encapResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &Response{}
+	if err := proto.Unmarshal(binaryResp, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, decoded
+}
+
+func TestGatewayHandlerProtoHTTPRequestWithRewriteToAllowedTarget(t *testing.T) {
+	target := createMockRewriteGatewayServer(t)
+
+	resp, decoded := sendAndDecapsulateProtoHTTPRequest(t, target, REWRITE_SOURCE_ALLOWED)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, resp.StatusCode))
+	}
+
+	if decoded.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusOK, decoded.StatusCode))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventTargetRewrite, metricsResultTargetRewritten)
+}
+
+func TestGatewayHandlerProtoHTTPRequestWithRewriteToForbiddenTarget(t *testing.T) {
+	target := createMockRewriteGatewayServer(t)
+
+	resp, decoded := sendAndDecapsulateProtoHTTPRequest(t, target, REWRITE_SOURCE_FORBIDDEN)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, resp.StatusCode))
+	}
+
+	if decoded.StatusCode != http.StatusForbidden {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusForbidden, decoded.StatusCode))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultTargetRequestForbidden)
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventTargetRewrite, metricsResultTargetRewritten)
+}
+
+func TestGatewayHandlerProtoHTTPRequestWithNoMatchingRewrite(t *testing.T) {
+	// REWRITE_SOURCE_UNMATCHED matches no rewrite, so the request still
+	// targets the original client-facing host. Backing the gateway with
+	// an allowlist double (rather than ForbiddenCheckHttpRequestHandler,
+	// which only ever rejects FORBIDDEN_TARGET) exercises the intended
+	// default-deny behavior: an unrewritten, non-allowlisted host is
+	// forbidden.
+	target := createMockRewriteGatewayServerWithAllowlist(t)
+
+	resp, decoded := sendAndDecapsulateProtoHTTPRequest(t, target, REWRITE_SOURCE_UNMATCHED)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, resp.StatusCode))
+	}
+
+	if decoded.StatusCode != http.StatusForbidden {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusForbidden, decoded.StatusCode))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultTargetRequestForbidden)
+}
+
+func TestGatewayHandlerWithMultipleActiveKeys(t *testing.T) {
+	target := createMockEchoGatewayServerWithKeys(t, FIXED_KEY_ID, ALTERNATE_KEY_ID)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	client := mustClient(t, target, ALTERNATE_KEY_ID)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+}
+
+func TestGatewayHandlerWithRetiredKey(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+	target.keys.RetireConfig(FIXED_KEY_ID)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	client := mustClient(t, target, FIXED_KEY_ID)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// A retiring key is still served and accepted until it is removed, so
+	// clients that cached the old config keep working through the
+	// rotation window.
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultSuccess)
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventKeyRotation, metricsResultRetiredKey)
+}
+
+func TestGatewayHandlerWithRemovedKey(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	client := mustClient(t, target, FIXED_KEY_ID)
+
+	target.keys.RetireConfig(FIXED_KEY_ID)
+	if !target.keys.HasPendingRetirement() {
+		t.Fatal("Expected a pending retirement after RetireConfig")
+	}
+
+	target.keys.Remove(FIXED_KEY_ID)
+	if target.keys.HasPendingRetirement() {
+		t.Fatal("Expected no pending retirement once the key is removed")
+	}
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := client.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, echoEndpoint, bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Content-Type", "message/ohttp-req")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// A removed key completes the rotation RetireConfig started: it is no
+	// longer accepted, even though a client may still have it cached.
+	if status := rr.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusUnauthorized, status))
+	}
+
+	testMetricsContainsResult(t, mustGetMetricsFactory(t, target), metricsEventGatewayRequest, metricsResultConfigurationMismatch)
+}
+
+// blockingEncapsulationHandler is a test EncapsulationHandler that signals
+// acquired once it starts handling a request and then blocks until release
+// is closed, so tests can deterministically hold a concurrency slot open.
+type blockingEncapsulationHandler struct {
+	acquired chan struct{}
+	release  chan struct{}
+}
+
+func (h blockingEncapsulationHandler) Handle(ctx context.Context, encapsulatedRequest []byte, metrics Metrics) ([]byte, error) {
+	close(h.acquired)
+	<-h.release
+	metrics.Fire(metricsResultSuccess)
+	return []byte{}, nil
+}
+
+func TestGatewayHandlerThrottlesAtMaxRequestsInFlight(t *testing.T) {
+	acquired := make(chan struct{})
+	release := make(chan struct{})
+	metricsFactory := &MockMetricsFactory{}
+
+	target := newGatewayResource(nil, map[string]EncapsulationHandler{
+		gatewayEndpoint: blockingEncapsulationHandler{acquired: acquired, release: release},
+	}, false, metricsFactory, 1)
+
+	handler := http.HandlerFunc(target.gatewayHandler)
+
+	newRequest := func(t *testing.T) *http.Request {
+		request, err := http.NewRequest(http.MethodPost, gatewayEndpoint, bytes.NewReader(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Add("Content-Type", "message/ohttp-req")
+		return request
+	}
+
+	firstDone := make(chan struct{})
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newRequest(t))
+		close(firstDone)
+	}()
+	<-acquired
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest(t))
+
+	if status := rr.Result().StatusCode; status != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusServiceUnavailable, status))
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter == "" {
+		t.Fatal("Expected a Retry-After header on the throttled response")
+	}
+
+	close(release)
+	<-firstDone
+
+	foundThrottled := false
+	for _, metric := range metricsFactory.results() {
+		if metric.eventName == metricsEventGatewayRequest && metric.result == metricsResultThrottled {
+			foundThrottled = true
+		}
+	}
+	if !foundThrottled {
+		t.Fatal("Expected a throttled result to be recorded")
+	}
+}
+
+// blockingAppRequestHandler is a test AppRequestHandler analogous to
+// blockingEncapsulationHandler, used to hold open the long-running
+// semaphore in ProtoHTTPEncapsulationHandler.
+type blockingAppRequestHandler struct {
+	acquired chan struct{}
+	release  chan struct{}
+}
+
+func (h blockingAppRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	close(h.acquired)
+	<-h.release
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+var LONG_RUNNING_TARGET = "slow.example"
+
+func TestGatewayHandlerThrottlesLongRunningTargetsSeparately(t *testing.T) {
+	keys := createKeyRegistry(t, FIXED_KEY_ID)
+	metricsFactory := &MockMetricsFactory{}
+	acquired := make(chan struct{})
+	release := make(chan struct{})
+
+	protoHandler := ProtoHTTPEncapsulationHandler{
+		httpHandler:               blockingAppRequestHandler{acquired: acquired, release: release},
+		metricsFactory:            metricsFactory,
+		longRunningRequestTargets: regexp.MustCompile(regexp.QuoteMeta(LONG_RUNNING_TARGET)),
+		longRunningSlots:          newSlots(1),
+	}
+
+	target := gatewayResource{
+		keys: keys,
+		encapsulationHandlers: map[string]EncapsulationHandler{
+			gatewayEndpoint: DefaultEncapsulationHandler{
+				keys:           keys,
+				appHandler:     protoHandler,
+				metricsFactory: metricsFactory,
+			},
+		},
+		metricsFactory: metricsFactory,
+	}
+
+	firstDone := make(chan struct{})
+	go func() {
+		sendAndDecapsulateProtoHTTPRequest(t, target, LONG_RUNNING_TARGET)
+		close(firstDone)
+	}()
+	<-acquired
+
+	_, decoded := sendAndDecapsulateProtoHTTPRequest(t, target, LONG_RUNNING_TARGET)
+	if decoded.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusServiceUnavailable, decoded.StatusCode))
+	}
+
+	close(release)
+	<-firstDone
+
+	foundThrottled := false
+	for _, metric := range metricsFactory.results() {
+		if metric.eventName == metricsEventGatewayRequest && metric.result == metricsResultThrottled {
+			foundThrottled = true
+		}
+	}
+	if !foundThrottled {
+		t.Fatal("Expected a throttled result to be recorded")
+	}
+}
+
+// conditionalBlockingAppRequestHandler is like blockingAppRequestHandler,
+// but only blocks on acquired/release for requests targeting blockTarget;
+// every other target succeeds immediately.
+type conditionalBlockingAppRequestHandler struct {
+	blockTarget string
+	acquired    chan struct{}
+	release     chan struct{}
+}
+
+func (h conditionalBlockingAppRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if req.Host == h.blockTarget {
+		close(h.acquired)
+		<-h.release
+	}
+	metrics.Fire(metricsResultSuccess)
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+// TestGatewayHandlerLongRunningRequestDoesNotHoldMainSlot combines
+// MaxRequestsInFlight with a long-running target, unlike
+// TestGatewayHandlerThrottlesLongRunningTargetsSeparately which leaves
+// MaxRequestsInFlight at 0 (unbounded) and so cannot observe the gateway's
+// shared pool at all. A request classified as long-running must release
+// its MaxRequestsInFlight slot so that a short request can still be served
+// while the long-running one is in flight.
+func TestGatewayHandlerLongRunningRequestDoesNotHoldMainSlot(t *testing.T) {
+	keys := createKeyRegistry(t, FIXED_KEY_ID)
+	metricsFactory := &MockMetricsFactory{}
+	acquired := make(chan struct{})
+	release := make(chan struct{})
+
+	protoHandler := ProtoHTTPEncapsulationHandler{
+		httpHandler:               conditionalBlockingAppRequestHandler{blockTarget: LONG_RUNNING_TARGET, acquired: acquired, release: release},
+		metricsFactory:            metricsFactory,
+		longRunningRequestTargets: regexp.MustCompile(regexp.QuoteMeta(LONG_RUNNING_TARGET)),
+		longRunningSlots:          newSlots(1),
+	}
+
+	target := newGatewayResource(keys, map[string]EncapsulationHandler{
+		gatewayEndpoint: DefaultEncapsulationHandler{
+			keys:           keys,
+			appHandler:     protoHandler,
+			metricsFactory: metricsFactory,
+		},
+	}, false, metricsFactory, 1)
+
+	firstDone := make(chan struct{})
+	go func() {
+		sendAndDecapsulateProtoHTTPRequest(t, target, LONG_RUNNING_TARGET)
+		close(firstDone)
+	}()
+	<-acquired
+
+	// The long-running request above should have given back the single
+	// MaxRequestsInFlight slot, so this short request to a different
+	// target must still be served rather than throttled.
+	_, decoded := sendAndDecapsulateProtoHTTPRequest(t, target, ALLOWED_TARGET)
+	if decoded.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Encapsulated result did not yield %d, got %d instead", http.StatusOK, decoded.StatusCode))
+	}
+
+	close(release)
+	<-firstDone
+}
+
+func TestGatewayHandlerOverUnixSocket(t *testing.T) {
+	target := createMockEchoGatewayServer(t)
+
+	socketPath := filepath.Join(t.TempDir(), "ohttp-gateway.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(echoEndpoint, target.gatewayHandler)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// Dial the Unix socket directly rather than going through the default
+	// transport's DNS/TCP dialer.
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+
+	ohttpClient := mustClient(t, target, FIXED_KEY_ID)
+	testMessage := []byte{0xCA, 0xFE}
+	req, _, err := ohttpClient.EncapsulateRequest(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Post("http://unix"+echoEndpoint, "message/ohttp-req", bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Errorf("Result did not yield %d, got %d instead", http.StatusOK, resp.StatusCode))
+	}
+	if resp.Header.Get("Content-Type") != "message/ohttp-res" {
+		t.Fatal("Invalid content type response")
+	}
+}
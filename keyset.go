@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/chris-wood/ohttp-go"
+)
+
+// keyRegistry holds the set of OHTTP configs the gateway currently serves,
+// keyed by their keyID. It supports adding and retiring keys at runtime so
+// that a key rotation does not require a restart or drop in-flight
+// requests: readers always see a complete, consistent set of gateways.
+type keyRegistry struct {
+	mu       sync.RWMutex
+	gateways map[uint8]ohttp.Gateway
+	retiring map[uint8]bool
+
+	newGatewayForKey func(keyID uint8) (ohttp.Gateway, error)
+}
+
+func newKeyRegistry(newGatewayForKey func(keyID uint8) (ohttp.Gateway, error)) *keyRegistry {
+	return &keyRegistry{
+		gateways:         make(map[uint8]ohttp.Gateway),
+		retiring:         make(map[uint8]bool),
+		newGatewayForKey: newGatewayForKey,
+	}
+}
+
+// AddConfig generates a new OHTTP config for keyID and adds it to the set
+// of keys the gateway will decapsulate requests with. If keyID was
+// previously scheduled for retirement, it is returned to active status.
+func (r *keyRegistry) AddConfig(keyID uint8) error {
+	gateway, err := r.newGatewayForKey(keyID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gateways[keyID] = gateway
+	delete(r.retiring, keyID)
+	return nil
+}
+
+// RetireConfig marks keyID as scheduled for removal. It continues to be
+// served and accepted until it is removed with Remove, so clients that
+// cached the old config keep working through the rotation window.
+func (r *keyRegistry) RetireConfig(keyID uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.gateways[keyID]; ok {
+		r.retiring[keyID] = true
+	}
+}
+
+// Remove drops keyID entirely; it is no longer advertised or accepted.
+func (r *keyRegistry) Remove(keyID uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.gateways, keyID)
+	delete(r.retiring, keyID)
+}
+
+// Gateway returns the active Gateway for keyID, if any.
+func (r *keyRegistry) Gateway(keyID uint8) (ohttp.Gateway, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	gateway, ok := r.gateways[keyID]
+	return gateway, ok
+}
+
+// IsRetiring reports whether keyID is scheduled for removal.
+func (r *keyRegistry) IsRetiring(keyID uint8) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.retiring[keyID]
+}
+
+// HasPendingRetirement reports whether any active key is scheduled for
+// removal.
+func (r *keyRegistry) HasPendingRetirement() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.retiring) > 0
+}
+
+// MarshalledConfigs returns the marshalled public config for every active
+// key, ordered by keyID, ready to be concatenated in a response per the
+// OHTTP key configuration format.
+func (r *keyRegistry) MarshalledConfigs() ([][]byte, error) {
+	r.mu.RLock()
+	keyIDs := make([]uint8, 0, len(r.gateways))
+	gateways := make(map[uint8]ohttp.Gateway, len(r.gateways))
+	for keyID, gateway := range r.gateways {
+		keyIDs = append(keyIDs, keyID)
+		gateways[keyID] = gateway
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+
+	marshalled := make([][]byte, 0, len(keyIDs))
+	for _, keyID := range keyIDs {
+		config, err := gateways[keyID].Config(keyID)
+		if err != nil {
+			return nil, err
+		}
+		marshalled = append(marshalled, config.Marshal())
+	}
+	return marshalled, nil
+}
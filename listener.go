@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// newListener builds the gateway's listener from a LISTEN value such as
+// "unix:///var/run/ohttp-gateway.sock" or "tcp://:8080". For a Unix domain
+// socket, any stale socket file left behind by a previous run is removed
+// before binding, and the socket is chmod'd to unixSocketMode afterward if
+// it is non-empty.
+func newListener(listen string, unixSocketMode string) (net.Listener, error) {
+	target, err := url.Parse(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN value %q: %w", listen, err)
+	}
+
+	switch target.Scheme {
+	case "unix":
+		return newUnixListener(target.Path, unixSocketMode)
+	case "tcp":
+		return net.Listen("tcp", target.Host)
+	default:
+		return nil, fmt.Errorf("unsupported LISTEN scheme %q", target.Scheme)
+	}
+}
+
+func newUnixListener(path string, unixSocketMode string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %q: %w", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if unixSocketMode == "" {
+		return listener, nil
+	}
+
+	mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("invalid UNIX_SOCKET_MODE %q: %w", unixSocketMode, err)
+	}
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
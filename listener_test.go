@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewListenerTCP(t *testing.T) {
+	listener, err := newListener("tcp://127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().Network() != "tcp" {
+		t.Fatalf("Expected a tcp listener, got %s", listener.Addr().Network())
+	}
+}
+
+func TestNewListenerUnsupportedScheme(t *testing.T) {
+	if _, err := newListener("udp://127.0.0.1:0", ""); err == nil {
+		t.Fatal("Expected an error for an unsupported LISTEN scheme")
+	}
+}
+
+func TestNewListenerInvalidURL(t *testing.T) {
+	if _, err := newListener("://not-a-url", ""); err == nil {
+		t.Fatal("Expected an error for an invalid LISTEN value")
+	}
+}
+
+func TestNewUnixListenerRemovesStaleSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "ohttp-gateway.sock")
+	if err := os.WriteFile(socketPath, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := newUnixListener(socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().Network() != "unix" {
+		t.Fatalf("Expected a unix listener, got %s", listener.Addr().Network())
+	}
+}
+
+func TestNewUnixListenerWithoutStaleSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "ohttp-gateway.sock")
+
+	listener, err := newUnixListener(socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Fatalf("Expected the socket file to exist after binding: %s", err)
+	}
+}
+
+func TestNewUnixListenerAppliesMode(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "ohttp-gateway.sock")
+
+	listener, err := newUnixListener(socketPath, "0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("Expected socket mode 0600, got %o", mode)
+	}
+}
+
+func TestNewUnixListenerInvalidMode(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "ohttp-gateway.sock")
+
+	if _, err := newUnixListener(socketPath, "not-an-octal-mode"); err == nil {
+		t.Fatal("Expected an error for an invalid UNIX_SOCKET_MODE")
+	}
+
+	if _, err := os.Stat(socketPath); err == nil {
+		t.Fatal("Expected the listener (and its socket file) to be cleaned up after an invalid mode")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/chris-wood/ohttp-go"
+	"github.com/cloudflare/circl/hpke"
+)
+
+const (
+	defaultPort = "8080"
+)
+
+func envOrDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func parseAllowedOrigins(raw string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			allowed[origin] = true
+		}
+	}
+	return allowed
+}
+
+// parseKeyIDs parses a comma-separated list of key IDs, as used by the
+// ADDITIONAL_KEY_IDS, ROTATE_IN_KEY_IDS, RETIRE_KEY_IDS, and
+// REMOVE_KEY_IDS env vars.
+func parseKeyIDs(raw string) ([]uint8, error) {
+	var keyIDs []uint8
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		keyIDs = append(keyIDs, uint8(value))
+	}
+	return keyIDs, nil
+}
+
+func newGatewayForKey(keyID uint8) (ohttp.Gateway, error) {
+	config, err := ohttp.NewConfig(keyID, hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	if err != nil {
+		return ohttp.Gateway{}, err
+	}
+	return ohttp.NewDefaultGateway([]ohttp.PrivateConfig{config}), nil
+}
+
+// handleKeyRotationSignals lets an operator rotate keys at runtime by
+// sending the process SIGHUP: every key ID in ROTATE_IN_KEY_IDS is added
+// (or, if already retiring, restored to active), every key ID in
+// RETIRE_KEY_IDS is scheduled for removal, and every key ID in
+// REMOVE_KEY_IDS is dropped entirely, completing a previously retired
+// key's rotation. The env vars are read once per SIGHUP, and all three are
+// parsed before any change is made, so an invalid value leaves the keys
+// untouched. The changes are then applied one key at a time, each under the
+// keyRegistry's lock: a request that arrives mid-rotation can see some of
+// them applied and not others, while in-flight requests against keys that
+// are not being retired or removed are unaffected.
+func handleKeyRotationSignals(keys *keyRegistry) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		rotateIn, err := parseKeyIDs(os.Getenv("ROTATE_IN_KEY_IDS"))
+		if err != nil {
+			log.Printf("Invalid ROTATE_IN_KEY_IDS: %s", err)
+			continue
+		}
+		retire, err := parseKeyIDs(os.Getenv("RETIRE_KEY_IDS"))
+		if err != nil {
+			log.Printf("Invalid RETIRE_KEY_IDS: %s", err)
+			continue
+		}
+		remove, err := parseKeyIDs(os.Getenv("REMOVE_KEY_IDS"))
+		if err != nil {
+			log.Printf("Invalid REMOVE_KEY_IDS: %s", err)
+			continue
+		}
+
+		for _, keyID := range rotateIn {
+			if err := keys.AddConfig(keyID); err != nil {
+				log.Printf("Failed to rotate in key %d: %s", keyID, err)
+			}
+		}
+		for _, keyID := range retire {
+			keys.RetireConfig(keyID)
+		}
+		for _, keyID := range remove {
+			keys.Remove(keyID)
+		}
+	}
+}
+
+func main() {
+	keyIDValue, err := strconv.ParseUint(envOrDefault("FIXED_KEY_ID", "0"), 10, 8)
+	if err != nil {
+		log.Fatalf("Invalid FIXED_KEY_ID: %s", err)
+	}
+	keyID := uint8(keyIDValue)
+
+	keys := newKeyRegistry(newGatewayForKey)
+	if err := keys.AddConfig(keyID); err != nil {
+		log.Fatalf("Failed to instantiate OHTTP config: %s", err)
+	}
+
+	additionalKeyIDs, err := parseKeyIDs(os.Getenv("ADDITIONAL_KEY_IDS"))
+	if err != nil {
+		log.Fatalf("Invalid ADDITIONAL_KEY_IDS: %s", err)
+	}
+	for _, additionalKeyID := range additionalKeyIDs {
+		if err := keys.AddConfig(additionalKeyID); err != nil {
+			log.Fatalf("Failed to instantiate OHTTP config for key %d: %s", additionalKeyID, err)
+		}
+	}
+
+	allowedOrigins := parseAllowedOrigins(os.Getenv("ALLOWED_TARGET_ORIGINS"))
+	debugResponse := os.Getenv("GATEWAY_DEBUG") == "true"
+
+	targetRewrites, err := parseTargetRewrites(os.Getenv("TARGET_REWRITES"))
+	if err != nil {
+		log.Fatalf("Invalid TARGET_REWRITES: %s", err)
+	}
+
+	maxRequestsInFlight, err := strconv.Atoi(envOrDefault("MAX_REQUESTS_IN_FLIGHT", "0"))
+	if err != nil {
+		log.Fatalf("Invalid MAX_REQUESTS_IN_FLIGHT: %s", err)
+	}
+
+	maxLongRunningRequestsInFlight, err := strconv.Atoi(envOrDefault("MAX_LONG_RUNNING_REQUESTS_IN_FLIGHT", "0"))
+	if err != nil {
+		log.Fatalf("Invalid MAX_LONG_RUNNING_REQUESTS_IN_FLIGHT: %s", err)
+	}
+
+	var longRunningRequestTargets *regexp.Regexp
+	if raw := os.Getenv("LONG_RUNNING_TARGETS_RE"); raw != "" {
+		longRunningRequestTargets, err = regexp.Compile(raw)
+		if err != nil {
+			log.Fatalf("Invalid LONG_RUNNING_TARGETS_RE: %s", err)
+		}
+	}
+
+	metricsFactory := &StandardMetricsFactory{}
+
+	encapHandlers := map[string]EncapsulationHandler{
+		gatewayEndpoint: DefaultEncapsulationHandler{
+			keys: keys,
+			appHandler: ProtoHTTPEncapsulationHandler{
+				httpHandler: HttpRequestHandler{
+					client:         http.DefaultClient,
+					allowedOrigins: allowedOrigins,
+				},
+				targetRewrites:            targetRewrites,
+				metricsFactory:            metricsFactory,
+				longRunningRequestTargets: longRunningRequestTargets,
+				longRunningSlots:          newSlots(maxLongRunningRequestsInFlight),
+			},
+			metricsFactory: metricsFactory,
+		},
+	}
+	if debugResponse {
+		encapHandlers[echoEndpoint] = DefaultEncapsulationHandler{
+			keys:           keys,
+			appHandler:     EchoAppHandler{},
+			metricsFactory: metricsFactory,
+		}
+	}
+
+	target := newGatewayResource(keys, encapHandlers, debugResponse, metricsFactory, maxRequestsInFlight)
+
+	go handleKeyRotationSignals(keys)
+
+	http.HandleFunc(configEndpoint, target.configHandler)
+	http.HandleFunc(gatewayEndpoint, target.gatewayHandler)
+	if debugResponse {
+		http.HandleFunc(echoEndpoint, target.gatewayHandler)
+	}
+
+	listen := envOrDefault("LISTEN", "tcp://:"+envOrDefault("PORT", defaultPort))
+	listener, err := newListener(listen, os.Getenv("UNIX_SOCKET_MODE"))
+	if err != nil {
+		log.Fatalf("Failed to create listener: %s", err)
+	}
+
+	log.Printf("Starting gateway on %s", listener.Addr())
+	log.Fatal(http.Serve(listener, nil))
+}
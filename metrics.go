@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+)
+
+const (
+	metricsEventGatewayRequest = "gateway_request"
+	metricsEventConfigRequest  = "config_request"
+	metricsEventTargetRewrite  = "target_rewrite"
+	metricsEventKeyRotation    = "key_rotation"
+
+	metricsResultSuccess                = "success"
+	metricsResultInvalidMethod          = "invalid_method"
+	metricsResultInvalidContentType     = "invalid_content_type"
+	metricsResultDecapsulationFailed    = "decapsulation_failed"
+	metricsResultConfigurationMismatch  = "configuration_mismatch"
+	metricsResultTargetRequestForbidden = "target_request_forbidden"
+	metricsResultNotFound               = "not_found"
+	metricsResultTargetRewritten        = "target_rewritten"
+	metricsResultRetiredKey             = "retired_key"
+	metricsResultThrottled              = "throttled"
+)
+
+// Metrics fires a single named result for an event that a Metrics instance
+// was created for. Implementations must tolerate being fired at most once;
+// callers thread the same Metrics instance through a request's handling
+// chain so that exactly one outcome is recorded per event.
+type Metrics interface {
+	Fire(result string)
+}
+
+// MetricsFactory creates a Metrics instance scoped to a single occurrence
+// of the named event.
+type MetricsFactory interface {
+	Create(eventName string) Metrics
+}
+
+// StandardMetrics is the default Metrics implementation, which logs fired
+// results to the standard logger.
+type StandardMetrics struct {
+	eventName string
+}
+
+func (m *StandardMetrics) Fire(result string) {
+	log.Printf("event=%s result=%s", m.eventName, result)
+}
+
+// StandardMetricsFactory is the default MetricsFactory implementation used
+// by the gateway outside of tests.
+type StandardMetricsFactory struct{}
+
+func (f *StandardMetricsFactory) Create(eventName string) Metrics {
+	return &StandardMetrics{eventName: eventName}
+}
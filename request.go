@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// requestToProtoHTTP converts an http.Request into its Binary HTTP style
+// protobuf encoding so that it can be carried as the encapsulated content
+// of an OHTTP request.
+func requestToProtoHTTP(req *http.Request) (*Request, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	headers := make([]*Header, 0, len(req.Header))
+	for name, values := range req.Header {
+		for _, value := range values {
+			headers = append(headers, &Header{Key: name, Value: value})
+		}
+	}
+
+	return &Request{
+		Method:  req.Method,
+		Scheme:  req.URL.Scheme,
+		Host:    req.Host,
+		Path:    req.URL.RequestURI(),
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// protoHTTPToRequest is the reverse of requestToProtoHTTP: it reconstructs
+// an http.Request from its Binary HTTP style protobuf encoding.
+func protoHTTPToRequest(req *Request) (*http.Request, error) {
+	httpReq, err := http.NewRequest(req.Method, req.Scheme+"://"+req.Host+req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range req.Headers {
+		httpReq.Header.Add(header.Key, header.Value)
+	}
+	httpReq.Host = req.Host
+
+	return httpReq, nil
+}
+
+// responseToProtoHTTP converts an http.Response into its Binary HTTP style
+// protobuf encoding so that it can be carried as the encapsulated content
+// of an OHTTP response.
+func responseToProtoHTTP(resp *http.Response) (*Response, error) {
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	headers := make([]*Header, 0, len(resp.Header))
+	for name, values := range resp.Header {
+		for _, value := range values {
+			headers = append(headers, &Header{Key: name, Value: value})
+		}
+	}
+
+	return &Response{
+		StatusCode: int32(resp.StatusCode),
+		Headers:    headers,
+		Body:       body,
+	}, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// TargetRewrite describes how an incoming target host should be rewritten
+// before the request is dispatched to the app handler.
+type TargetRewrite struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	Port   string `json:"port,omitempty"`
+}
+
+// parseTargetRewrites parses the TARGET_REWRITES JSON document: an object
+// mapping an incoming target host to the TargetRewrite that should replace
+// it. An empty document yields no rewrites.
+func parseTargetRewrites(raw string) (map[string]TargetRewrite, error) {
+	rewrites := make(map[string]TargetRewrite)
+	if raw == "" {
+		return rewrites, nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), &rewrites); err != nil {
+		return nil, err
+	}
+
+	return rewrites, nil
+}
+
+// applyTargetRewrite mutates req in place so that it targets the host
+// named by rewrite instead of its original target.
+func applyTargetRewrite(req *http.Request, rewrite TargetRewrite) {
+	host := rewrite.Host
+	if rewrite.Port != "" {
+		host = net.JoinHostPort(rewrite.Host, rewrite.Port)
+	}
+
+	req.URL.Scheme = rewrite.Scheme
+	req.URL.Host = host
+	req.Host = host
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+)
+
+// HttpRequestHandler forwards a decapsulated request to its target origin,
+// provided that origin appears in allowedOrigins. It is the production
+// AppRequestHandler wired up behind ProtoHTTPEncapsulationHandler.
+type HttpRequestHandler struct {
+	client         *http.Client
+	allowedOrigins map[string]bool
+}
+
+func (h HttpRequestHandler) Handle(req *http.Request, metrics Metrics) (*http.Response, error) {
+	if !h.allowedOrigins[req.Host] {
+		metrics.Fire(metricsResultTargetRequestForbidden)
+		return nil, TargetForbiddenError
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.Fire(metricsResultSuccess)
+	return resp, nil
+}